@@ -0,0 +1,195 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	subscriberQueueSize = 32               // chunks buffered per listener before we start dropping
+	captureIdleTimeout  = 30 * time.Second // how long to keep parec alive with zero listeners
+	broadcastChunkSize  = 8192
+)
+
+// broadcaster owns the single live Capture reader and fans its output out to
+// every /stream, /stream.<fmt> and /hls listener, instead of each of them
+// spawning its own capture process. Capture starts on the first subscriber
+// and stops captureIdleTimeout after the last one leaves.
+type broadcaster struct {
+	server *AudioServer
+
+	mu        sync.Mutex
+	subs      map[int]*subscriber
+	nextID    int
+	capture   Capture
+	running   bool
+	idleTimer *time.Timer
+
+	dropsTotal uint64 // atomic
+}
+
+// subscriber is one listener's bounded inbox. The reader goroutine drops the
+// oldest buffered chunk rather than block when a slow client falls behind.
+type subscriber struct {
+	id int
+	ch chan []byte
+}
+
+func newBroadcaster(s *AudioServer) *broadcaster {
+	return &broadcaster{
+		server: s,
+		subs:   make(map[int]*subscriber),
+	}
+}
+
+// subscribe registers a new listener and starts the capture if this is the
+// first one. The returned func must be called exactly once to unsubscribe.
+func (b *broadcaster) subscribe() (<-chan []byte, func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.running {
+		if err := b.startLocked(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if b.idleTimer != nil {
+		b.idleTimer.Stop()
+		b.idleTimer = nil
+	}
+
+	id := b.nextID
+	b.nextID++
+	sub := &subscriber{id: id, ch: make(chan []byte, subscriberQueueSize)}
+	b.subs[id] = sub
+
+	return sub.ch, func() { b.unsubscribe(id) }, nil
+}
+
+func (b *broadcaster) unsubscribe(id int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if sub, ok := b.subs[id]; ok {
+		close(sub.ch)
+		delete(b.subs, id)
+	}
+
+	if len(b.subs) == 0 && b.idleTimer == nil {
+		b.idleTimer = time.AfterFunc(captureIdleTimeout, b.stopIfStillIdle)
+	}
+}
+
+func (b *broadcaster) stopIfStillIdle() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.subs) == 0 {
+		b.stopLocked()
+	}
+	b.idleTimer = nil
+}
+
+func (b *broadcaster) startLocked() error {
+	capture, err := b.server.newStreamCapture()
+	if err != nil {
+		return err
+	}
+	stream, err := capture.Start(b.server.captureFormat())
+	if err != nil {
+		return err
+	}
+
+	b.capture = capture
+	b.running = true
+	go b.readLoop(stream)
+	return nil
+}
+
+func (b *broadcaster) stopLocked() {
+	if !b.running {
+		return
+	}
+	b.capture.Stop()
+	b.capture = nil
+	b.running = false
+}
+
+// readLoop is the single goroutine that reads the shared capture and fans
+// each chunk out to every subscriber. A subscriber whose queue is full has
+// its oldest chunk dropped to make room, rather than stalling everyone else.
+func (b *broadcaster) readLoop(stream io.ReadCloser) {
+	defer stream.Close()
+
+	buffer := make([]byte, broadcastChunkSize)
+	for {
+		n, err := stream.Read(buffer)
+		if n > 0 {
+			chunk := make([]byte, n)
+			copy(chunk, buffer[:n])
+			b.fanOut(chunk)
+		}
+		if err != nil {
+			b.mu.Lock()
+			b.running = false
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (b *broadcaster) fanOut(chunk []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, sub := range b.subs {
+		select {
+		case sub.ch <- chunk:
+		default:
+			// Slow client: drop its oldest buffered chunk and retry once.
+			select {
+			case <-sub.ch:
+				atomic.AddUint64(&b.dropsTotal, 1)
+			default:
+			}
+			select {
+			case sub.ch <- chunk:
+			default:
+			}
+		}
+	}
+}
+
+func (b *broadcaster) stats() (captureRunning bool, queueDepth int, dropsTotal uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	depth := 0
+	for _, sub := range b.subs {
+		if n := len(sub.ch); n > depth {
+			depth = n
+		}
+	}
+	return b.running, depth, atomic.LoadUint64(&b.dropsTotal)
+}
+
+// chanReader adapts a broadcaster subscription channel to an io.Reader so it
+// can be wired directly into an ffmpeg Stdin pipe.
+type chanReader struct {
+	ch  <-chan []byte
+	buf []byte
+}
+
+func (c *chanReader) Read(p []byte) (int, error) {
+	if len(c.buf) == 0 {
+		chunk, ok := <-c.ch
+		if !ok {
+			return 0, io.EOF
+		}
+		c.buf = chunk
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Format describes the raw PCM layout a Capture backend produces. All
+// current backends normalize to s16le so the rest of the pipeline (ICY
+// encoders, HLS, the broadcaster) never needs to care where the audio came
+// from.
+type Format struct {
+	SampleRate int
+	Channels   int
+	LatencyMs  int
+}
+
+func (f Format) String() string {
+	return fmt.Sprintf("s16le/%d/%d", f.SampleRate, f.Channels)
+}
+
+// Source is one selectable input device/monitor exposed by a Capture
+// backend, as returned by GET /sources.
+type Source struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Capture is implemented by every platform-specific audio capture backend.
+// Start begins reading audio in the given format and returns a stream that
+// yields raw PCM until Stop is called or the process exits on its own.
+type Capture interface {
+	Name() string
+	Sources() []Source
+	Start(format Format) (io.ReadCloser, error)
+	Stop()
+}
+
+// newCapture builds the Capture backend named by cfg.Server.Capture.Backend,
+// defaulting to "pulse" for backward compatibility with existing configs.
+func newCapture(cfg *Config) (Capture, error) {
+	name := cfg.Server.Capture.Backend
+	if name == "" {
+		name = "pulse"
+	}
+
+	switch name {
+	case "pulse":
+		return &pulseCapture{device: cfg.Server.Capture.Device}, nil
+	case "pipewire":
+		return &pipewireCapture{device: cfg.Server.Capture.Device}, nil
+	case "alsa":
+		return &alsaCapture{device: cfg.Server.Capture.Device}, nil
+	case "wasapi":
+		return &wasapiCapture{device: cfg.Server.Capture.Device}, nil
+	case "coreaudio":
+		return &coreaudioCapture{device: cfg.Server.Capture.Device}, nil
+	case "file":
+		return &fileCapture{path: cfg.Server.Capture.Device}, nil
+	default:
+		return nil, fmt.Errorf("unknown capture backend %q", name)
+	}
+}
+
+// cmdCapture is the shared bits for backends that just shell out to a
+// recorder binary and hand back its stdout.
+type cmdCapture struct {
+	cmd *exec.Cmd
+}
+
+func (c *cmdCapture) startCmd(name string, args ...string) (io.ReadCloser, error) {
+	cmd := exec.Command(name, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	c.cmd = cmd
+	return stdout, nil
+}
+
+func (c *cmdCapture) Stop() {
+	killAndReap(c.cmd)
+}
+
+// killAndReap kills a running subprocess and reaps it asynchronously, so a
+// disconnecting listener or a capture restart doesn't leave a zombie behind.
+func killAndReap(cmd *exec.Cmd) {
+	if cmd == nil || cmd.Process == nil {
+		return
+	}
+	cmd.Process.Kill()
+	go cmd.Wait()
+}
+
+// pulseCapture is the original parec-based backend for PulseAudio on Linux.
+type pulseCapture struct {
+	cmdCapture
+	device string
+}
+
+func (p *pulseCapture) Name() string { return "pulse" }
+
+func (p *pulseCapture) Sources() []Source {
+	return pactlSources()
+}
+
+func (p *pulseCapture) Start(format Format) (io.ReadCloser, error) {
+	latencyMs := format.LatencyMs
+	if latencyMs <= 0 {
+		latencyMs = 50
+	}
+	args := []string{
+		"--format=s16le",
+		fmt.Sprintf("--rate=%d", format.SampleRate),
+		fmt.Sprintf("--channels=%d", format.Channels),
+		fmt.Sprintf("--latency-msec=%d", latencyMs),
+	}
+	if p.device != "" {
+		args = append(args, "--device="+p.device)
+	}
+	return p.startCmd("parec", args...)
+}
+
+// pipewireCapture uses PipeWire's pw-record, which speaks the same raw PCM
+// CLI conventions as parec.
+type pipewireCapture struct {
+	cmdCapture
+	device string
+}
+
+func (p *pipewireCapture) Name() string { return "pipewire" }
+
+func (p *pipewireCapture) Sources() []Source {
+	return pactlSources()
+}
+
+func (p *pipewireCapture) Start(format Format) (io.ReadCloser, error) {
+	args := []string{
+		"--format=s16",
+		fmt.Sprintf("--rate=%d", format.SampleRate),
+		fmt.Sprintf("--channels=%d", format.Channels),
+	}
+	if p.device != "" {
+		args = append(args, "--target="+p.device)
+	}
+	args = append(args, "-")
+	return p.startCmd("pw-record", args...)
+}
+
+// alsaCapture uses arecord against a raw ALSA device, for systems without a
+// PulseAudio/PipeWire session.
+type alsaCapture struct {
+	cmdCapture
+	device string
+}
+
+func (a *alsaCapture) Name() string { return "alsa" }
+
+func (a *alsaCapture) Sources() []Source {
+	out, err := exec.Command("arecord", "-L").Output()
+	if err != nil {
+		return nil
+	}
+	return parseArecordSources(string(out))
+}
+
+func (a *alsaCapture) Start(format Format) (io.ReadCloser, error) {
+	device := a.device
+	if device == "" {
+		device = "default"
+	}
+	args := []string{
+		"-D", device,
+		"-f", "S16_LE",
+		"-r", fmt.Sprintf("%d", format.SampleRate),
+		"-c", fmt.Sprintf("%d", format.Channels),
+		"-t", "raw",
+	}
+	return a.startCmd("arecord", args...)
+}
+
+// wasapiCapture captures the Windows loopback device through ffmpeg's
+// dshow/wasapi input rather than a cgo IAudioClient binding, to keep the
+// build free of cgo.
+type wasapiCapture struct {
+	cmdCapture
+	device string
+}
+
+func (w *wasapiCapture) Name() string { return "wasapi" }
+
+func (w *wasapiCapture) Sources() []Source {
+	// Enumerating dshow devices requires parsing ffmpeg's stderr; left as a
+	// manual config.yml entry (capture.device) for now.
+	return nil
+}
+
+func (w *wasapiCapture) Start(format Format) (io.ReadCloser, error) {
+	device := w.device
+	if device == "" {
+		device = "audio=virtual-audio-capturer"
+	}
+	args := []string{
+		"-f", "dshow",
+		"-i", device,
+		"-f", "s16le",
+		"-ar", fmt.Sprintf("%d", format.SampleRate),
+		"-ac", fmt.Sprintf("%d", format.Channels),
+		"-",
+	}
+	return w.startCmd("ffmpeg", args...)
+}
+
+// coreaudioCapture captures macOS system audio via ffmpeg's avfoundation
+// input (typically aggregated with a loopback driver like BlackHole).
+type coreaudioCapture struct {
+	cmdCapture
+	device string
+}
+
+func (c *coreaudioCapture) Name() string { return "coreaudio" }
+
+func (c *coreaudioCapture) Sources() []Source {
+	return nil
+}
+
+func (c *coreaudioCapture) Start(format Format) (io.ReadCloser, error) {
+	device := c.device
+	if device == "" {
+		device = ":0"
+	}
+	args := []string{
+		"-f", "avfoundation",
+		"-i", device,
+		"-f", "s16le",
+		"-ar", fmt.Sprintf("%d", format.SampleRate),
+		"-ac", fmt.Sprintf("%d", format.Channels),
+		"-",
+	}
+	return c.startCmd("ffmpeg", args...)
+}
+
+// fileCapture loops a local WAV/FLAC file through ffmpeg, handy for
+// development and demos without a live audio source.
+type fileCapture struct {
+	cmdCapture
+	path string
+}
+
+func (f *fileCapture) Name() string { return "file" }
+
+func (f *fileCapture) Sources() []Source {
+	if f.path == "" {
+		return nil
+	}
+	return []Source{{ID: f.path, Name: f.path, Description: "looped file source"}}
+}
+
+func (f *fileCapture) Start(format Format) (io.ReadCloser, error) {
+	if f.path == "" {
+		return nil, fmt.Errorf("capture.device must name a file for the file backend")
+	}
+	args := []string{
+		"-stream_loop", "-1",
+		"-i", f.path,
+		"-f", "s16le",
+		"-ar", fmt.Sprintf("%d", format.SampleRate),
+		"-ac", fmt.Sprintf("%d", format.Channels),
+		"-",
+	}
+	return f.startCmd("ffmpeg", args...)
+}
+
+// pactlSources lists PulseAudio monitor sources, shared by the pulse and
+// pipewire backends since pipewire-pulse exposes the same pactl interface.
+func pactlSources() []Source {
+	out, err := exec.Command("pactl", "list", "sources", "short").Output()
+	if err != nil {
+		return nil
+	}
+
+	var sources []Source
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		sources = append(sources, Source{ID: fields[1], Name: fields[1]})
+	}
+	return sources
+}
+
+// parseArecordSources turns `arecord -L` output into device Sources, one per
+// top-level (non-indented) device name.
+func parseArecordSources(listing string) []Source {
+	var sources []Source
+	for _, line := range strings.Split(listing, "\n") {
+		if line == "" || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		sources = append(sources, Source{ID: line, Name: line})
+	}
+	return sources
+}
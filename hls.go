@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hlsSegmentDuration = 2 * time.Second
+	hlsPartDuration    = 200 * time.Millisecond
+	hlsWindowSize      = 6 // segments kept in the sliding window
+	hlsPartsPerSegment = int(hlsSegmentDuration / hlsPartDuration)
+	hlsIdleTimeout     = 30 * time.Second // how long to keep the encoder alive with no /hls/* requests
+)
+
+// hlsSegment is one fMP4 media segment produced by the encoder goroutine,
+// along with the low-latency parts it was assembled from.
+type hlsSegment struct {
+	seq   int
+	data  []byte
+	parts [][]byte // 200ms LL-HLS partial segments, in order
+	done  bool     // true once the final part has been appended
+}
+
+// hlsRing is the in-memory sliding window of recent segments, plus the
+// sync.Cond listeners block on for low-latency "give me the next part" polls.
+type hlsRing struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	segments map[int]*hlsSegment
+	firstSeq int
+	nextSeq  int
+	discSeq  int
+	init     []byte // ftyp+moov box pair, served via #EXT-X-MAP
+	stopped  bool   // true once the encoder run that would produce msn has ended
+
+	runMu       sync.Mutex
+	running     bool
+	idleTimer   *time.Timer
+	unsubscribe func()
+	cmd         *exec.Cmd
+}
+
+func newHLSRing() *hlsRing {
+	r := &hlsRing{segments: make(map[int]*hlsSegment)}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+func (s *AudioServer) startHLS() {
+	s.hls = newHLSRing()
+}
+
+// ensureRunning starts the encoder goroutine on the first /hls/* request and
+// pushes its idle deadline out on every subsequent one, so HLS behaves like
+// every other output: it only holds a broadcaster subscription (and keeps
+// the shared capture alive) while someone is actually polling it.
+func (r *hlsRing) ensureRunning(s *AudioServer) {
+	r.runMu.Lock()
+	defer r.runMu.Unlock()
+
+	if r.idleTimer != nil {
+		r.idleTimer.Stop()
+	}
+	r.idleTimer = time.AfterFunc(hlsIdleTimeout, func() { r.stopIfIdle() })
+
+	if r.running {
+		return
+	}
+	r.running = true
+	go r.run(s)
+}
+
+// stopIfIdle tears down the encoder after hlsIdleTimeout passes with no
+// /hls/* request to reset it. The encoder goroutine also notices its own
+// pipeline dying (e.g. ffmpeg crashing) and clears running itself.
+func (r *hlsRing) stopIfIdle() {
+	r.runMu.Lock()
+	unsubscribe, cmd := r.unsubscribe, r.cmd
+	r.runMu.Unlock()
+
+	if unsubscribe != nil {
+		unsubscribe()
+	}
+	killAndReap(cmd)
+}
+
+// markStopped clears the running state so the next /hls/* request restarts
+// the encoder. It's idempotent: both a natural pipeline death and an
+// idle-timeout teardown end up calling it. It also wakes any waitForPart
+// callers blocked on a part this run will now never produce.
+func (r *hlsRing) markStopped() {
+	r.runMu.Lock()
+	r.running = false
+	r.unsubscribe = nil
+	r.cmd = nil
+	r.runMu.Unlock()
+
+	r.mu.Lock()
+	r.stopped = true
+	r.cond.Broadcast()
+	r.mu.Unlock()
+}
+
+// resetForNewRun clears the segment window for a fresh encoder run, bumping
+// the discontinuity sequence if this isn't the very first run so players
+// know the timeline restarted.
+func (r *hlsRing) resetForNewRun() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.nextSeq > 0 {
+		r.discSeq++
+	}
+	r.segments = make(map[int]*hlsSegment)
+	r.firstSeq = r.nextSeq
+	r.init = nil
+	r.stopped = false
+}
+
+// run subscribes to the server's shared broadcaster (the same capture feed
+// used by every other endpoint) and turns it into rolling fMP4 segments,
+// splitting each 2s segment into ten 200ms LL-HLS parts. It returns (and
+// clears r.running) whenever the pipeline ends, whether that's ffmpeg dying
+// or stopIfIdle tearing it down.
+func (r *hlsRing) run(s *AudioServer) {
+	r.resetForNewRun()
+	defer r.markStopped()
+
+	ch, unsubscribe, err := s.broadcast.subscribe()
+	if err != nil {
+		return
+	}
+
+	ffmpeg := exec.Command("ffmpeg",
+		"-f", "s16le", "-ar", "48000", "-ac", "2", "-i", "pipe:0",
+		"-c:a", "aac", "-b:a", "128k",
+		"-f", "mp4",
+		"-movflags", "frag_keyframe+empty_moov+default_base_moof",
+		"-frag_duration", fmt.Sprintf("%d", hlsPartDuration.Microseconds()),
+		"pipe:1",
+	)
+	ffmpeg.Stdin = &chanReader{ch: ch}
+	out, err := ffmpeg.StdoutPipe()
+	if err != nil {
+		unsubscribe()
+		return
+	}
+
+	if err := ffmpeg.Start(); err != nil {
+		unsubscribe()
+		return
+	}
+
+	r.runMu.Lock()
+	r.unsubscribe = unsubscribe
+	r.cmd = ffmpeg
+	r.runMu.Unlock()
+
+	r.demux(out)
+
+	killAndReap(ffmpeg)
+	unsubscribe()
+}
+
+// readMP4Box reads one ISO-BMFF box (the [size uint32][type 4cc][payload]
+// layout ffmpeg's fragmented-mp4 muxer emits) and returns its 4CC type plus
+// the raw bytes of the whole box, header included, so callers can pass
+// segments straight through to HTTP clients unmodified.
+func readMP4Box(br *bufio.Reader) (boxType string, raw []byte, err error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return "", nil, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size < 8 {
+		return "", nil, fmt.Errorf("hls: invalid mp4 box size %d", size)
+	}
+	boxType = string(header[4:8])
+	raw = make([]byte, size)
+	copy(raw, header)
+	if _, err := io.ReadFull(br, raw[8:]); err != nil {
+		return "", nil, err
+	}
+	return boxType, raw, nil
+}
+
+// demux reads the muxed fMP4 stream box by box. The leading ftyp+moov pair
+// (empty thanks to -movflags empty_moov) becomes the LL-HLS init segment;
+// every moof that follows starts a new fragment, which becomes one 200ms
+// part, with hlsPartsPerSegment parts rotated into a completed segment.
+func (r *hlsRing) demux(src io.Reader) {
+	br := bufio.NewReaderSize(src, 64*1024)
+
+	var init []byte
+	for {
+		boxType, raw, err := readMP4Box(br)
+		if err != nil {
+			return
+		}
+		init = append(init, raw...)
+		if boxType == "moov" {
+			break
+		}
+	}
+	r.setInit(init)
+
+	var fragment []byte
+	partsInSegment := 0
+	for {
+		boxType, raw, err := readMP4Box(br)
+		if err != nil {
+			return
+		}
+		if boxType == "moof" && len(fragment) > 0 {
+			r.flushPart(fragment)
+			fragment = nil
+			partsInSegment++
+			if partsInSegment >= hlsPartsPerSegment {
+				r.rotateSegment()
+				partsInSegment = 0
+			}
+		}
+		fragment = append(fragment, raw...)
+	}
+}
+
+func (r *hlsRing) setInit(init []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init = init
+}
+
+func (r *hlsRing) flushPart(part []byte) {
+	if len(part) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seg, ok := r.segments[r.nextSeq]
+	if !ok {
+		seg = &hlsSegment{seq: r.nextSeq}
+		r.segments[r.nextSeq] = seg
+	}
+	seg.parts = append(seg.parts, part)
+	seg.data = append(seg.data, part...)
+	r.cond.Broadcast()
+}
+
+func (r *hlsRing) rotateSegment() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if seg, ok := r.segments[r.nextSeq]; ok {
+		seg.done = true
+	}
+	r.nextSeq++
+	if len(r.segments) > hlsWindowSize {
+		delete(r.segments, r.firstSeq)
+		r.firstSeq++
+	}
+	r.cond.Broadcast()
+}
+
+// playlist renders the current #EXTM3U window, including LL-HLS #EXT-X-PART
+// tags for the in-progress segment. Every URI it emits (the init segment,
+// each completed segment, each in-progress part) is backed by a handler
+// registered under /hls/.
+func (r *hlsRing) playlist() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:6\n")
+	b.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(hlsSegmentDuration.Seconds())))
+	b.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", r.firstSeq))
+	b.WriteString(fmt.Sprintf("#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", r.discSeq))
+	b.WriteString("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES\n")
+	b.WriteString(fmt.Sprintf("#EXT-X-PART-INF:PART-TARGET=%.3f\n", hlsPartDuration.Seconds()))
+	if len(r.init) > 0 {
+		b.WriteString("#EXT-X-MAP:URI=\"init.mp4\"\n")
+	}
+
+	for seq := r.firstSeq; seq < r.nextSeq; seq++ {
+		if _, ok := r.segments[seq]; !ok {
+			continue
+		}
+		b.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", hlsSegmentDuration.Seconds()))
+		b.WriteString(fmt.Sprintf("seg-%d.m4s\n", seq))
+	}
+
+	if seg, ok := r.segments[r.nextSeq]; ok {
+		for idx := range seg.parts {
+			b.WriteString(fmt.Sprintf("#EXT-X-PART:DURATION=%.3f,URI=\"part-%d-%d.m4s\"\n",
+				hlsPartDuration.Seconds(), seg.seq, idx))
+		}
+	}
+
+	return b.String()
+}
+
+// waitForPart blocks (via sync.Cond) until the requested media sequence /
+// part index has been produced, implementing the _HLS_msn/_HLS_part blocking
+// reload contract. It returns early if ctx is canceled (the listener went
+// away) or if the encoder run that would have produced msn has ended, so a
+// dropped client or a dead ffmpeg pipeline can't leak the goroutine forever.
+func (r *hlsRing) waitForPart(ctx context.Context, msn, part int) {
+	// sync.Cond has no context support, so a watcher goroutine turns ctx
+	// cancellation into a Broadcast the wait loop below can observe.
+	watchDone := make(chan struct{})
+	defer close(watchDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.mu.Lock()
+			r.cond.Broadcast()
+			r.mu.Unlock()
+		case <-watchDone:
+		}
+	}()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		seg, ok := r.segments[msn]
+		if ok && (part < len(seg.parts) || seg.done) {
+			return
+		}
+		if msn < r.firstSeq || msn > r.nextSeq+1 {
+			return
+		}
+		if r.stopped || ctx.Err() != nil {
+			return
+		}
+		r.cond.Wait()
+	}
+}
+
+func (r *hlsRing) segmentData(seq int) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seg, ok := r.segments[seq]
+	if !ok || !seg.done {
+		return nil, false
+	}
+	return seg.data, true
+}
+
+func (r *hlsRing) partData(seq, idx int) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seg, ok := r.segments[seq]
+	if !ok || idx < 0 || idx >= len(seg.parts) {
+		return nil, false
+	}
+	return seg.parts[idx], true
+}
+
+func (r *hlsRing) initSegment() ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.init) == 0 {
+		return nil, false
+	}
+	return r.init, true
+}
+
+// handleHLS serves everything under /hls/: the playlist, the shared init
+// segment, completed segments, and in-progress LL-HLS parts. It's one
+// handler (rather than one route per file) because Go's default ServeMux
+// only prefix-matches patterns ending in "/" — segment and part names are
+// dynamic, so they have to be dispatched on here instead of registered
+// individually.
+func (s *AudioServer) handleHLS(w http.ResponseWriter, r *http.Request) {
+	if s.hls == nil {
+		http.Error(w, "HLS not running", 503)
+		return
+	}
+	s.hls.ensureRunning(s)
+
+	switch {
+	case r.URL.Path == "/hls/live.m3u8":
+		s.handleHLSPlaylist(w, r)
+	case r.URL.Path == "/hls/init.mp4":
+		s.handleHLSInit(w, r)
+	case strings.HasPrefix(r.URL.Path, "/hls/seg-"):
+		s.handleHLSSegment(w, r)
+	case strings.HasPrefix(r.URL.Path, "/hls/part-"):
+		s.handleHLSPart(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *AudioServer) handleHLSPlaylist(w http.ResponseWriter, r *http.Request) {
+	if msn := r.URL.Query().Get("_HLS_msn"); msn != "" {
+		seq, _ := strconv.Atoi(msn)
+		part := 0
+		if p := r.URL.Query().Get("_HLS_part"); p != "" {
+			part, _ = strconv.Atoi(p)
+		}
+		s.hls.waitForPart(r.Context(), seq, part)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write([]byte(s.hls.playlist()))
+}
+
+func (s *AudioServer) handleHLSInit(w http.ResponseWriter, r *http.Request) {
+	data, ok := s.hls.initSegment()
+	if !ok {
+		http.Error(w, "Init segment not available", 503)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Cache-Control", "public, max-age=60, immutable")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(data)
+}
+
+func (s *AudioServer) handleHLSSegment(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/hls/seg-")
+	name = strings.TrimSuffix(name, ".m4s")
+	seq, err := strconv.Atoi(name)
+	if err != nil {
+		http.Error(w, "Bad segment", 400)
+		return
+	}
+
+	data, ok := s.hls.segmentData(seq)
+	if !ok {
+		http.Error(w, "Segment not available", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Cache-Control", "public, max-age=60, immutable")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(data)
+}
+
+// handleHLSPart serves one LL-HLS partial segment named part-<seq>-<idx>.m4s,
+// as referenced by the #EXT-X-PART tags in the playlist.
+func (s *AudioServer) handleHLSPart(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/hls/part-")
+	name = strings.TrimSuffix(name, ".m4s")
+	pieces := strings.SplitN(name, "-", 2)
+	if len(pieces) != 2 {
+		http.Error(w, "Bad part", 400)
+		return
+	}
+	seq, err1 := strconv.Atoi(pieces[0])
+	idx, err2 := strconv.Atoi(pieces[1])
+	if err1 != nil || err2 != nil {
+		http.Error(w, "Bad part", 400)
+		return
+	}
+
+	data, ok := s.hls.partData(seq, idx)
+	if !ok {
+		http.Error(w, "Part not available", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(data)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// icyMetaInt is the number of audio bytes between inline ICY metadata blocks.
+// 16000 matches the default used by Icecast/Shoutcast sources.
+const icyMetaInt = 16000
+
+// encoderSpec describes one of the Icecast-compatible output formats: the
+// Content-Type served to listeners and the ffmpeg args used to transcode the
+// raw s16le/48000/stereo PCM coming out of the configured capture backend.
+type encoderSpec struct {
+	contentType string
+	ffmpegArgs  []string
+}
+
+var encoderSpecs = map[string]encoderSpec{
+	"mp3": {
+		contentType: "audio/mpeg",
+		ffmpegArgs:  []string{"-f", "mp3", "-codec:a", "libmp3lame", "-b:a", "192k"},
+	},
+	"aac": {
+		contentType: "audio/aac",
+		ffmpegArgs:  []string{"-f", "adts", "-codec:a", "aac", "-b:a", "160k"},
+	},
+	"ogg": {
+		contentType: "audio/ogg",
+		ffmpegArgs:  []string{"-f", "ogg", "-codec:a", "libvorbis", "-q:a", "5"},
+	},
+}
+
+// setStreamMetadata updates the title/source shown to ICY-aware clients.
+func (s *AudioServer) setStreamMetadata(title, source string) {
+	s.metaMu.Lock()
+	s.streamTitle = title
+	s.sourceApp = source
+	s.metaMu.Unlock()
+}
+
+func (s *AudioServer) currentStreamTitle() string {
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	if s.streamTitle != "" {
+		return s.streamTitle
+	}
+	if s.sourceApp != "" {
+		return s.sourceApp
+	}
+	return "soundsync"
+}
+
+var sinkInputAppNameRe = regexp.MustCompile(`application\.name\s*=\s*"([^"]*)"`)
+
+// pollSourceApp asks PulseAudio which application is currently feeding the
+// monitored sink, so the ICY StreamTitle has something more useful than
+// "soundsync" in it. Best-effort: any failure just leaves the title alone.
+func pollSourceApp() string {
+	out, err := exec.Command("pactl", "list", "sink-inputs").Output()
+	if err != nil {
+		return ""
+	}
+	m := sinkInputAppNameRe.FindSubmatch(out)
+	if m == nil {
+		return ""
+	}
+	return string(m[1])
+}
+
+// handleEncodedStream serves one of the Icecast-style endpoints
+// (/stream.mp3, /stream.aac, /stream.ogg). It pipes the live capture
+// through ffmpeg and, when the client asked for it via Icy-MetaData: 1,
+// interleaves StreamTitle metadata blocks every icyMetaInt bytes.
+func (s *AudioServer) handleEncodedStream(format string) http.HandlerFunc {
+	spec, ok := encoderSpecs[format]
+	if !ok {
+		panic("soundsync: unknown encoder format " + format)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		wantsICY := r.Header.Get("Icy-MetaData") == "1"
+
+		w.Header().Set("Content-Type", spec.contentType)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("icy-name", "soundsync")
+		w.Header().Set("icy-description", "live audio relay")
+		w.Header().Set("icy-pub", "0")
+		if wantsICY {
+			w.Header().Set("icy-metaint", strconv.Itoa(icyMetaInt))
+		}
+
+		s.mu.Lock()
+		s.listeners++
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			s.listeners--
+			s.mu.Unlock()
+		}()
+
+		ch, unsubscribe, err := s.broadcast.subscribe()
+		if err != nil {
+			http.Error(w, "Failed to start audio", 500)
+			return
+		}
+		defer unsubscribe()
+
+		ffmpeg := exec.Command("ffmpeg",
+			append([]string{
+				"-f", "s16le", "-ar", "48000", "-ac", "2", "-i", "pipe:0",
+			}, append(spec.ffmpegArgs, "pipe:1")...)...,
+		)
+		ffmpeg.Stdin = &chanReader{ch: ch}
+		encoded, err := ffmpeg.StdoutPipe()
+		if err != nil {
+			http.Error(w, "Failed to start encoder", 500)
+			return
+		}
+
+		if err := ffmpeg.Start(); err != nil {
+			http.Error(w, "Failed to start encoder", 500)
+			return
+		}
+		defer killAndReap(ffmpeg)
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming not supported", 500)
+			return
+		}
+
+		var out io.Writer = w
+		if wantsICY {
+			out = &icyWriter{s: s, w: w}
+		}
+
+		buffer := make([]byte, 8192)
+		for {
+			n, err := encoded.Read(buffer)
+			if err != nil || n == 0 {
+				break
+			}
+
+			s.mu.Lock()
+			s.totalBytes += uint64(n)
+			s.mu.Unlock()
+
+			if _, err := out.Write(buffer[:n]); err != nil {
+				break
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// icyWriter wraps an http.ResponseWriter and injects a StreamTitle metadata
+// block every icyMetaInt bytes of audio, as described by the Shoutcast/Icecast
+// ICY protocol.
+type icyWriter struct {
+	s        *AudioServer
+	w        io.Writer
+	sinceMsg int
+}
+
+func (iw *icyWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		remaining := icyMetaInt - iw.sinceMsg
+		chunk := p
+		if len(chunk) > remaining {
+			chunk = chunk[:remaining]
+		}
+
+		n, err := iw.w.Write(chunk)
+		total += n
+		iw.sinceMsg += n
+		if err != nil {
+			return total, err
+		}
+		if n < len(chunk) {
+			return total, io.ErrShortWrite
+		}
+
+		p = p[len(chunk):]
+
+		if iw.sinceMsg >= icyMetaInt {
+			if err := iw.writeMetaBlock(); err != nil {
+				return total, err
+			}
+			iw.sinceMsg = 0
+		}
+	}
+	return total, nil
+}
+
+func (iw *icyWriter) writeMetaBlock() error {
+	title := iw.s.currentStreamTitle()
+	title = strings.ReplaceAll(title, "'", "")
+
+	meta := []byte("StreamTitle='" + title + "';")
+	// Metadata is padded to a multiple of 16 bytes and prefixed with a
+	// single length byte counting those 16-byte groups.
+	padLen := (len(meta) + 15) / 16 * 16
+	block := make([]byte, padLen)
+	copy(block, meta)
+
+	lengthByte := byte(padLen / 16)
+	if _, err := iw.w.Write([]byte{lengthByte}); err != nil {
+		return err
+	}
+	if padLen == 0 {
+		return nil
+	}
+	_, err := iw.w.Write(block)
+	return err
+}
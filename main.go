@@ -6,7 +6,6 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"runtime"
 	"strconv"
 	"strings"
@@ -18,8 +17,16 @@ import (
 
 type Config struct {
 	Server struct {
-		IP   string `yaml:"ip"`
-		Port int    `yaml:"port"`
+		IP      string `yaml:"ip"`
+		Port    int    `yaml:"port"`
+		Capture struct {
+			Backend    string `yaml:"backend"`
+			Device     string `yaml:"device"`
+			SampleRate int    `yaml:"sample_rate"`
+			Channels   int    `yaml:"channels"`
+			LatencyMs  int    `yaml:"latency_ms"`
+		} `yaml:"capture"`
+		Encoders []encoderProfile `yaml:"encoders"`
 	} `yaml:"server"`
 }
 
@@ -29,13 +36,24 @@ type AudioServer struct {
 	totalBytes uint64
 	startTime  time.Time
 	listeners  int
+
+	metaMu      sync.RWMutex
+	streamTitle string
+	sourceApp   string
+
+	hls *hlsRing
+
+	broadcast *broadcaster
 }
 
 type Stats struct {
-	Listeners int     `json:"listeners"`
-	CPU       float64 `json:"cpu"`
-	RAM       uint64  `json:"ram"`
-	Bandwidth float64 `json:"bandwidth"`
+	Listeners      int     `json:"listeners"`
+	CPU            float64 `json:"cpu"`
+	RAM            uint64  `json:"ram"`
+	Bandwidth      float64 `json:"bandwidth"`
+	CaptureRunning bool    `json:"capture_running"`
+	QueueDepth     int     `json:"queue_depth"`
+	DropsTotal     uint64  `json:"drops_total"`
 }
 
 func loadConfig() *Config {
@@ -44,20 +62,72 @@ func loadConfig() *Config {
 		cfg := &Config{}
 		cfg.Server.IP = "0.0.0.0"
 		cfg.Server.Port = 8080
+		cfg.Server.Capture.Backend = "pulse"
+		cfg.Server.Capture.SampleRate = 48000
+		cfg.Server.Capture.Channels = 2
+		cfg.Server.Capture.LatencyMs = 50
 		d, _ := yaml.Marshal(cfg)
 		os.WriteFile("config.yml", d, 0644)
 		return cfg
 	}
 	var cfg Config
 	yaml.Unmarshal(data, &cfg)
+	if cfg.Server.Capture.Backend == "" {
+		cfg.Server.Capture.Backend = "pulse"
+	}
+	if cfg.Server.Capture.SampleRate == 0 {
+		cfg.Server.Capture.SampleRate = 48000
+	}
+	if cfg.Server.Capture.Channels == 0 {
+		cfg.Server.Capture.Channels = 2
+	}
 	return &cfg
 }
 
 func NewAudioServer(cfg *Config) *AudioServer {
-	return &AudioServer{
+	s := &AudioServer{
 		config:    cfg,
 		startTime: time.Now(),
 	}
+	s.broadcast = newBroadcaster(s)
+	return s
+}
+
+// newStreamCapture builds a fresh Capture for a single listener/encoder
+// pipeline, using whichever backend config.yml selects.
+func (s *AudioServer) newStreamCapture() (Capture, error) {
+	c, err := newCapture(s.config)
+	if err != nil {
+		log.Printf("capture backend: %v, falling back to pulse", err)
+		return newCapture(&Config{})
+	}
+	return c, nil
+}
+
+func (s *AudioServer) captureFormat() Format {
+	return Format{
+		SampleRate: s.config.Server.Capture.SampleRate,
+		Channels:   s.config.Server.Capture.Channels,
+		LatencyMs:  s.config.Server.Capture.LatencyMs,
+	}
+}
+
+func (s *AudioServer) handleSources(w http.ResponseWriter, r *http.Request) {
+	c, err := s.newStreamCapture()
+	if err != nil {
+		http.Error(w, "No capture backend available", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(struct {
+		Backend string   `json:"backend"`
+		Sources []Source `json:"sources"`
+	}{
+		Backend: c.Name(),
+		Sources: c.Sources(),
+	})
 }
 
 func (s *AudioServer) handleStream(w http.ResponseWriter, r *http.Request) {
@@ -76,24 +146,12 @@ func (s *AudioServer) handleStream(w http.ResponseWriter, r *http.Request) {
 		s.mu.Unlock()
 	}()
 
-	cmd := exec.Command("parec",
-		"--format=s16le",
-		"--rate=48000",
-		"--channels=2",
-		"--latency-msec=50",
-	)
-
-	stdout, err := cmd.StdoutPipe()
+	ch, unsubscribe, err := s.broadcast.subscribe()
 	if err != nil {
 		http.Error(w, "Failed to start audio", 500)
 		return
 	}
-
-	if err := cmd.Start(); err != nil {
-		http.Error(w, "Failed to start audio", 500)
-		return
-	}
-	defer cmd.Process.Kill()
+	defer unsubscribe()
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
@@ -101,18 +159,12 @@ func (s *AudioServer) handleStream(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	buffer := make([]byte, 8192)
-	for {
-		n, err := stdout.Read(buffer)
-		if err != nil || n == 0 {
-			break
-		}
-
+	for chunk := range ch {
 		s.mu.Lock()
-		s.totalBytes += uint64(n)
+		s.totalBytes += uint64(len(chunk))
 		s.mu.Unlock()
 
-		if _, err := w.Write(buffer[:n]); err != nil {
+		if _, err := w.Write(chunk); err != nil {
 			break
 		}
 		flusher.Flush()
@@ -168,11 +220,16 @@ func (s *AudioServer) handleStats(w http.ResponseWriter, r *http.Request) {
 		bandwidth = float64(bytes) / elapsed / 1024
 	}
 
+	captureRunning, queueDepth, dropsTotal := s.broadcast.stats()
+
 	stats := Stats{
-		Listeners: listeners,
-		CPU:       getCPUUsage(),
-		RAM:       getRAMUsage(),
-		Bandwidth: bandwidth,
+		Listeners:      listeners,
+		CPU:            getCPUUsage(),
+		RAM:            getRAMUsage(),
+		Bandwidth:      bandwidth,
+		CaptureRunning: captureRunning,
+		QueueDepth:     queueDepth,
+		DropsTotal:     dropsTotal,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -180,6 +237,40 @@ func (s *AudioServer) handleStats(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(stats)
 }
 
+func (s *AudioServer) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	var body struct {
+		Title  string `json:"title"`
+		Source string `json:"source"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid metadata", 400)
+		return
+	}
+
+	s.setStreamMetadata(body.Title, body.Source)
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(204)
+}
+
+// pollMetadataLoop periodically refreshes the source application name from
+// PulseAudio so ICY clients see it even when nobody calls PUT /metadata.
+func (s *AudioServer) pollMetadataLoop() {
+	for {
+		if app := pollSourceApp(); app != "" {
+			s.metaMu.Lock()
+			s.sourceApp = app
+			s.metaMu.Unlock()
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
 func (s *AudioServer) serveHTML(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 	w.Write([]byte(htmlContent))
@@ -473,6 +564,8 @@ background:#f00;
 </head>
 <body>
 <div class="player">
+<audio id="hlsAudio" style="display:none" playsinline></audio>
+<audio id="webmAudio" style="display:none" playsinline></audio>
 <div class="header">
 <h2>soundsync player</h2>
 </div>
@@ -510,6 +603,22 @@ background:#f00;
 <div class="stat-label">ping</div>
 <div class="stat-value" id="ping">0 ms</div>
 </div>
+<div class="stat">
+<div class="stat-label">capture</div>
+<div class="stat-value" id="capture">-</div>
+</div>
+<div class="stat">
+<div class="stat-label">drops</div>
+<div class="stat-value" id="drops">0</div>
+</div>
+<div class="stat">
+<div class="stat-label">track</div>
+<div class="stat-value" id="track">-</div>
+</div>
+<div class="stat">
+<div class="stat-label">peak</div>
+<div class="stat-value" id="peak">0/0</div>
+</div>
 </div>
 <div class="chart">
 <div class="chart-label">spectrum</div>
@@ -556,14 +665,22 @@ window.addEventListener('resize',()=>setTimeout(resizeCanvases,100));
 
 const st=document.getElementById('st');
 const btn=document.getElementById('btn');
+const hlsAudio=document.getElementById('hlsAudio');
+const hlsSupported=hlsAudio.canPlayType('application/vnd.apple.mpegurl')!=='';
+const webmAudio=document.getElementById('webmAudio');
+const webmSupported=typeof MediaSource!=='undefined'&&MediaSource.isTypeSupported('audio/webm;codecs=opus');
 let ac,gain,bassFilter,an,running=false,reader,audioQueue=[];
+let usingHLS=false,usingWebM=false,mediaSource,sourceBuffer,webmReader;
 let vol=1,bassVal=0;
+let eventsWS=null,usingServerEvents=false,serverSpectrumBins=null;
 
 document.getElementById('vol').oninput=e=>{
 vol=e.target.value/100;
 document.getElementById('vv').textContent=e.target.value;
 document.getElementById('voldisp').textContent=e.target.value+'%';
 if(gain)gain.gain.value=vol;
+if(usingHLS)hlsAudio.volume=Math.min(vol,1);
+if(usingWebM)webmAudio.volume=Math.min(vol,1);
 };
 
 document.getElementById('bassCtrl').oninput=e=>{
@@ -579,10 +696,29 @@ else init();
 
 function stopStream(){
 running=false;
+disconnectEvents();
 if(reader){
 reader.cancel().catch(()=>{});
 reader=null;
 }
+if(usingHLS){
+hlsAudio.pause();
+hlsAudio.removeAttribute('src');
+hlsAudio.load();
+usingHLS=false;
+}
+if(usingWebM){
+usingWebM=false;
+webmAudio.pause();
+webmAudio.removeAttribute('src');
+webmAudio.load();
+if(webmReader){
+webmReader.cancel().catch(()=>{});
+webmReader=null;
+}
+mediaSource=null;
+sourceBuffer=null;
+}
 st.textContent='stopped';
 st.classList.remove('st');
 btn.textContent='start';
@@ -604,6 +740,64 @@ navigator.mediaSession.playbackState='none';
 }
 }
 
+function connectEvents(){
+if(eventsWS)return;
+const proto=location.protocol==='https:'?'wss:':'ws:';
+try{
+eventsWS=new WebSocket(proto+'//'+location.host+'/ws/events');
+}catch(e){
+eventsWS=null;
+return;
+}
+
+eventsWS.onopen=()=>{
+usingServerEvents=true;
+};
+
+eventsWS.onmessage=e=>{
+let msg;
+try{
+msg=JSON.parse(e.data);
+}catch(err){
+return;
+}
+switch(msg.type){
+case'stats':
+document.getElementById('listeners').textContent=msg.listeners;
+document.getElementById('cpu').textContent=msg.cpu.toFixed(1)+'%';
+document.getElementById('ram').textContent=msg.ram+' MB';
+document.getElementById('bw').textContent=msg.bandwidth.toFixed(1)+' KB/s';
+document.getElementById('capture').textContent=msg.capture_running?'running':'stopped';
+document.getElementById('drops').textContent=msg.drops_total;
+break;
+case'spectrum':
+serverSpectrumBins=msg.bins.map(v=>Math.min(255,v*2000));
+break;
+case'metadata':
+document.getElementById('track').textContent=msg.title||msg.source||'-';
+break;
+case'peak':
+document.getElementById('peak').textContent=Math.round(msg.l*100)+'/'+Math.round(msg.r*100);
+break;
+}
+};
+
+eventsWS.onclose=eventsWS.onerror=()=>{
+usingServerEvents=false;
+serverSpectrumBins=null;
+eventsWS=null;
+};
+}
+
+function disconnectEvents(){
+usingServerEvents=false;
+serverSpectrumBins=null;
+if(eventsWS){
+eventsWS.close();
+eventsWS=null;
+}
+}
+
 function setupMediaSession(){
 if('mediaSession'in navigator){
 navigator.mediaSession.metadata=new MediaMetadata({
@@ -618,8 +812,117 @@ navigator.mediaSession.playbackState='playing';
 }
 }
 
+function initHLS(){
+usingHLS=true;
+setupMediaSession();
+hlsAudio.src='/hls/live.m3u8';
+hlsAudio.volume=vol;
+
+hlsAudio.onplaying=()=>{
+st.textContent='playing';
+st.classList.add('st');
+btn.textContent='stop';
+btn.classList.add('stop');
+running=true;
+if(window.opener){
+window.opener.postMessage({action:'playing'},'*');
+}
+connectEvents();
+visualize();
+};
+
+hlsAudio.onerror=()=>{
+st.textContent='error';
+st.classList.remove('st');
+running=false;
+btn.textContent='start';
+btn.classList.remove('stop');
+};
+
+hlsAudio.play().catch(()=>{
+st.textContent='error';
+});
+}
+
+async function pumpWebM(){
+while(usingWebM&&webmReader){
+let chunk;
+try{
+const{done,value}=await webmReader.read();
+if(done||!usingWebM)break;
+chunk=value;
+}catch(e){
+break;
+}
+if(sourceBuffer.updating){
+await new Promise(resolve=>sourceBuffer.addEventListener('updateend',resolve,{once:true}));
+}
+if(!usingWebM)break;
+try{
+sourceBuffer.appendBuffer(chunk);
+}catch(e){
+break;
+}
+}
+}
+
+function initWebM(){
+usingWebM=true;
+setupMediaSession();
+
+mediaSource=new MediaSource();
+webmAudio.src=URL.createObjectURL(mediaSource);
+webmAudio.volume=vol;
+
+mediaSource.addEventListener('sourceopen',async()=>{
+sourceBuffer=mediaSource.addSourceBuffer('audio/webm;codecs=opus');
+try{
+const res=await fetch('/stream.webm');
+if(!res.ok)throw new Error('stream failed');
+webmReader=res.body.getReader();
+pumpWebM();
+}catch(e){
+st.textContent='error';
+usingWebM=false;
+}
+});
+
+webmAudio.onplaying=()=>{
+st.textContent='playing';
+st.classList.add('st');
+btn.textContent='stop';
+btn.classList.add('stop');
+running=true;
+if(window.opener){
+window.opener.postMessage({action:'playing'},'*');
+}
+connectEvents();
+visualize();
+};
+
+webmAudio.onerror=()=>{
+st.textContent='error';
+st.classList.remove('st');
+running=false;
+btn.textContent='start';
+btn.classList.remove('stop');
+};
+
+webmAudio.play().catch(()=>{
+st.textContent='error';
+});
+}
+
 async function init(){
 if(running)return;
+if(hlsSupported){
+initHLS();
+return;
+}
+if(webmSupported){
+initWebM();
+return;
+}
 try{
 setupMediaSession();
 
@@ -664,6 +967,7 @@ navigator.mediaSession.playbackState='playing';
 }
 
 let pending=new Uint8Array(0);
+connectEvents();
 visualize();
 processQueue();
 
@@ -755,13 +1059,20 @@ nextPlayTime+=buf.duration;
 }
 
 function visualize(){
-if(!running||!an){
-if(running)requestAnimationFrame(visualize);
+if(!running){
 return;
 }
 
-const freqData=new Uint8Array(an.frequencyBinCount);
+let freqData;
+if(usingServerEvents&&serverSpectrumBins){
+freqData=serverSpectrumBins;
+}else if(an){
+freqData=new Uint8Array(an.frequencyBinCount);
 an.getByteFrequencyData(freqData);
+}else{
+requestAnimationFrame(visualize);
+return;
+}
 
 const sr=specCanvas.getBoundingClientRect();
 const br=bassCanvas.getBoundingClientRect();
@@ -804,6 +1115,8 @@ pingTime=0;
 }
 
 setInterval(async()=>{
+document.getElementById('ping').textContent=pingTime+' ms';
+if(usingServerEvents)return;
 try{
 const r=await fetch('/stats');
 const data=await r.json();
@@ -811,7 +1124,8 @@ document.getElementById('listeners').textContent=data.listeners;
 document.getElementById('cpu').textContent=data.cpu.toFixed(1)+'%';
 document.getElementById('ram').textContent=data.ram+' MB';
 document.getElementById('bw').textContent=data.bandwidth.toFixed(1)+' KB/s';
-document.getElementById('ping').textContent=pingTime+' ms';
+document.getElementById('capture').textContent=data.capture_running?'running':'stopped';
+document.getElementById('drops').textContent=data.drops_total;
 }catch(e){}
 },1000);
 
@@ -837,9 +1151,21 @@ func main() {
 	cfg := loadConfig()
 	server := NewAudioServer(cfg)
 
+	go server.pollMetadataLoop()
+	server.startHLS()
+
 	http.HandleFunc("/", server.serveHTML)
 	http.HandleFunc("/player", server.servePlayer)
 	http.HandleFunc("/stream", server.handleStream)
+	http.HandleFunc("/stream.mp3", server.handleEncodedStream("mp3"))
+	http.HandleFunc("/stream.aac", server.handleEncodedStream("aac"))
+	http.HandleFunc("/stream.ogg", server.handleEncodedStream("ogg"))
+	http.HandleFunc("/metadata", server.handleMetadata)
+	http.HandleFunc("/hls/", server.handleHLS)
+	http.HandleFunc("/stream.webm", server.handleOpusWebM)
+	http.HandleFunc("/ws/opus", server.handleOpusWS)
+	http.HandleFunc("/ws/events", server.handleEvents)
+	http.HandleFunc("/sources", server.handleSources)
 	http.HandleFunc("/stats", server.handleStats)
 	http.HandleFunc("/ping", server.handlePing)
 	http.HandleFunc("/favicon.ico", server.serveFavicon)
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strconv"
+)
+
+// encoderProfile is one configured Opus output variant, e.g. a low-bitrate
+// stream for cellular listeners and a high-bitrate one for broadband.
+type encoderProfile struct {
+	Name       string `yaml:"name"`
+	Bitrate    int    `yaml:"bitrate"`
+	Complexity int    `yaml:"complexity"`
+}
+
+const defaultOpusBitrate = 96000
+
+// handleOpusWebM serves /stream.webm: the shared capture transcoded to
+// Opus-in-WebM via ffmpeg, suitable for MediaSource playback over
+// low-bandwidth connections.
+func (s *AudioServer) handleOpusWebM(w http.ResponseWriter, r *http.Request) {
+	bitrate := defaultOpusBitrate
+	complexity := 10
+	if profile := s.encoderProfile(r.URL.Query().Get("profile")); profile != nil {
+		bitrate = profile.Bitrate
+		complexity = profile.Complexity
+	}
+
+	w.Header().Set("Content-Type", "audio/webm;codecs=opus")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	s.mu.Lock()
+	s.listeners++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.listeners--
+		s.mu.Unlock()
+	}()
+
+	ch, unsubscribe, err := s.broadcast.subscribe()
+	if err != nil {
+		http.Error(w, "Failed to start audio", 500)
+		return
+	}
+	defer unsubscribe()
+
+	args := []string{
+		"-f", "s16le", "-ar", "48000", "-ac", "2", "-i", "pipe:0",
+		"-c:a", "libopus",
+		"-b:a", fmt.Sprintf("%dk", bitrate/1000),
+		"-compression_level", strconv.Itoa(complexity),
+		"-application", "audio",
+		"-f", "webm",
+		"-live", "1",
+		"pipe:1",
+	}
+	ffmpeg := exec.Command("ffmpeg", args...)
+	ffmpeg.Stdin = &chanReader{ch: ch}
+	encoded, err := ffmpeg.StdoutPipe()
+	if err != nil {
+		http.Error(w, "Failed to start encoder", 500)
+		return
+	}
+	if err := ffmpeg.Start(); err != nil {
+		http.Error(w, "Failed to start encoder", 500)
+		return
+	}
+	defer killAndReap(ffmpeg)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", 500)
+		return
+	}
+
+	buffer := make([]byte, 8192)
+	for {
+		n, err := encoded.Read(buffer)
+		if err != nil || n == 0 {
+			break
+		}
+
+		s.mu.Lock()
+		s.totalBytes += uint64(n)
+		s.mu.Unlock()
+
+		if _, err := w.Write(buffer[:n]); err != nil {
+			break
+		}
+		flusher.Flush()
+	}
+}
+
+// encoderProfile looks up a named encoder from config.yml's encoders: list,
+// falling back to the default bitrate/complexity when name is empty or
+// unknown.
+func (s *AudioServer) encoderProfile(name string) *encoderProfile {
+	if name == "" {
+		return nil
+	}
+	for _, p := range s.config.Server.Encoders {
+		if p.Name == name {
+			profile := p
+			return &profile
+		}
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var eventsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+const (
+	statsEventHz    = 1
+	spectrumEventHz = 20
+	fftSize         = 256 // matches the player's AnalyserNode fftSize
+)
+
+type statsEvent struct {
+	Type           string  `json:"type"`
+	Listeners      int     `json:"listeners"`
+	CPU            float64 `json:"cpu"`
+	RAM            uint64  `json:"ram"`
+	Bandwidth      float64 `json:"bandwidth"`
+	CaptureRunning bool    `json:"capture_running"`
+	QueueDepth     int     `json:"queue_depth"`
+	DropsTotal     uint64  `json:"drops_total"`
+}
+
+type spectrumEvent struct {
+	Type string    `json:"type"`
+	Bins []float64 `json:"bins"`
+}
+
+type metadataEvent struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Source string `json:"source"`
+}
+
+type peakEvent struct {
+	Type string  `json:"type"`
+	L    float64 `json:"l"`
+	R    float64 `json:"r"`
+}
+
+// handleEvents serves /ws/events: a single authoritative WebSocket feed of
+// stats, spectrum, metadata and peak-level events, so multiple listeners
+// (synchronized visualizers, karaoke overlays, party mode) see identical
+// numbers instead of each computing their own FFT client-side.
+func (s *AudioServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	conn, err := eventsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.listeners++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.listeners--
+		s.mu.Unlock()
+	}()
+
+	ch, unsubscribe, err := s.broadcast.subscribe()
+	if err != nil {
+		return
+	}
+	defer unsubscribe()
+
+	done := make(chan struct{})
+	var closeOnce sync.Once
+	stop := func() { closeOnce.Do(func() { close(done) }) }
+
+	// gorilla requires an app to keep reading even when it never expects
+	// inbound messages, so control frames (ping/pong/close) get processed
+	// and a dropped client is actually noticed.
+	go func() {
+		defer stop()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	writeCh := make(chan interface{}, 32)
+	go func() {
+		defer stop()
+		for {
+			select {
+			case msg := <-writeCh:
+				if err := conn.WriteJSON(msg); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	go s.pumpStatsEvents(writeCh, done)
+	s.pumpPCMEvents(ch, writeCh, done)
+}
+
+func (s *AudioServer) pumpStatsEvents(out chan<- interface{}, done <-chan struct{}) {
+	ticker := time.NewTicker(time.Second / statsEventHz)
+	defer ticker.Stop()
+
+	lastTitle, lastSource := "", ""
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.mu.RLock()
+			listeners := s.listeners
+			bytes := s.totalBytes
+			elapsed := time.Since(s.startTime).Seconds()
+			s.mu.RUnlock()
+
+			bandwidth := 0.0
+			if elapsed > 0 {
+				bandwidth = float64(bytes) / elapsed / 1024
+			}
+			captureRunning, queueDepth, dropsTotal := s.broadcast.stats()
+
+			select {
+			case out <- statsEvent{
+				Type:           "stats",
+				Listeners:      listeners,
+				CPU:            getCPUUsage(),
+				RAM:            getRAMUsage(),
+				Bandwidth:      bandwidth,
+				CaptureRunning: captureRunning,
+				QueueDepth:     queueDepth,
+				DropsTotal:     dropsTotal,
+			}:
+			case <-done:
+				return
+			}
+
+			s.metaMu.RLock()
+			title, source := s.streamTitle, s.sourceApp
+			s.metaMu.RUnlock()
+			if title != lastTitle || source != lastSource {
+				lastTitle, lastSource = title, source
+				select {
+				case out <- metadataEvent{Type: "metadata", Title: title, Source: source}:
+				case <-done:
+					return
+				}
+			}
+		}
+	}
+}
+
+// pumpPCMEvents consumes the broadcaster's raw PCM chunks, emitting a
+// spectrum event spectrumEventHz times a second (via a small radix-2 FFT
+// over the most recent fftSize samples) and a peak/RMS event on every
+// chunk.
+func (s *AudioServer) pumpPCMEvents(ch <-chan []byte, out chan<- interface{}, done <-chan struct{}) {
+	window := make([]float64, 0, fftSize)
+	nextSpectrum := time.Now()
+	spectrumInterval := time.Second / spectrumEventHz
+
+	for {
+		var chunk []byte
+		var ok bool
+		select {
+		case chunk, ok = <-ch:
+			if !ok {
+				return
+			}
+		case <-done:
+			return
+		}
+
+		peakL, peakR := 0.0, 0.0
+		samples := len(chunk) / 4
+		for i := 0; i < samples; i++ {
+			idx := i * 4
+			l := float64(int16(uint16(chunk[idx])|uint16(chunk[idx+1])<<8)) / 32768
+			r := float64(int16(uint16(chunk[idx+2])|uint16(chunk[idx+3])<<8)) / 32768
+			if math.Abs(l) > peakL {
+				peakL = math.Abs(l)
+			}
+			if math.Abs(r) > peakR {
+				peakR = math.Abs(r)
+			}
+			window = append(window, (l+r)/2)
+		}
+		if len(window) > fftSize {
+			window = window[len(window)-fftSize:]
+		}
+
+		select {
+		case out <- peakEvent{Type: "peak", L: peakL, R: peakR}:
+		case <-done:
+			return
+		}
+
+		if time.Now().After(nextSpectrum) && len(window) == fftSize {
+			nextSpectrum = time.Now().Add(spectrumInterval)
+			bins := magnitudeSpectrum(window)
+			select {
+			case out <- spectrumEvent{Type: "spectrum", Bins: bins}:
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+// magnitudeSpectrum runs an in-place radix-2 Cooley-Tukey FFT over a
+// Hann-windowed copy of samples (len(samples) must be a power of two) and
+// returns the magnitude of the first half of the bins.
+func magnitudeSpectrum(samples []float64) []float64 {
+	n := len(samples)
+	re := make([]float64, n)
+	im := make([]float64, n)
+	for i, v := range samples {
+		hann := 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n-1))
+		re[i] = v * hann
+	}
+
+	fft(re, im)
+
+	bins := make([]float64, n/2)
+	for i := range bins {
+		bins[i] = math.Sqrt(re[i]*re[i]+im[i]*im[i]) / float64(n)
+	}
+	return bins
+}
+
+// fft is an iterative in-place radix-2 Cooley-Tukey FFT. len(re) must be a
+// power of two; im must be the same length (zeroed for a real-valued input).
+func fft(re, im []float64) {
+	n := len(re)
+
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j &^= bit
+		}
+		j |= bit
+		if i < j {
+			re[i], re[j] = re[j], re[i]
+			im[i], im[j] = im[j], im[i]
+		}
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		half := size / 2
+		angleStep := -2 * math.Pi / float64(size)
+		for start := 0; start < n; start += size {
+			for k := 0; k < half; k++ {
+				angle := angleStep * float64(k)
+				wre, wim := math.Cos(angle), math.Sin(angle)
+
+				aRe, aIm := re[start+k], im[start+k]
+				bRe := re[start+k+half]*wre - im[start+k+half]*wim
+				bIm := re[start+k+half]*wim + im[start+k+half]*wre
+
+				re[start+k] = aRe + bRe
+				im[start+k] = aIm + bIm
+				re[start+k+half] = aRe - bRe
+				im[start+k+half] = aIm - bIm
+			}
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"os/exec"
+
+	"github.com/gorilla/websocket"
+)
+
+var opusUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// opusPacket is one decoded Opus packet pulled out of the Ogg container
+// ffmpeg produces, along with its presentation timestamp derived from the
+// page's granule position (48kHz sample clock).
+type opusPacket struct {
+	data        []byte
+	timestampMs uint64
+}
+
+// handleOpusWS serves /ws/opus: discrete Opus packets over a WebSocket,
+// each prefixed with an 8-byte big-endian millisecond timestamp, so a
+// WebCodecs AudioDecoder on the client can decode them without the
+// WebM/MediaSource machinery used by /stream.webm.
+func (s *AudioServer) handleOpusWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := opusUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.listeners++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.listeners--
+		s.mu.Unlock()
+	}()
+
+	ch, unsubscribe, err := s.broadcast.subscribe()
+	if err != nil {
+		return
+	}
+	defer unsubscribe()
+
+	ffmpeg := exec.Command("ffmpeg",
+		"-f", "s16le", "-ar", "48000", "-ac", "2", "-i", "pipe:0",
+		"-c:a", "libopus", "-b:a", "96k", "-application", "audio",
+		"-f", "ogg", "-page_duration", "20000",
+		"pipe:1",
+	)
+	ffmpeg.Stdin = &chanReader{ch: ch}
+	out, err := ffmpeg.StdoutPipe()
+	if err != nil {
+		return
+	}
+	if err := ffmpeg.Start(); err != nil {
+		return
+	}
+	defer killAndReap(ffmpeg)
+
+	packets := make(chan opusPacket, 64)
+	go demuxOggOpus(out, packets)
+
+	// gorilla requires an app to keep reading even when it never expects
+	// inbound messages, so control frames (ping/pong/close) get processed
+	// and a dropped client is actually noticed.
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case pkt, ok := <-packets:
+			if !ok {
+				return
+			}
+			msg := make([]byte, 8+len(pkt.data))
+			binary.BigEndian.PutUint64(msg[:8], pkt.timestampMs)
+			copy(msg[8:], pkt.data)
+			if err := conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+				return
+			}
+		case <-stopped:
+			return
+		}
+	}
+}
+
+// demuxOggOpus reads an Ogg Opus bitstream and emits each contained Opus
+// packet (skipping the OpusHead/OpusTags header packets) on packets, closing
+// it when src is exhausted. It implements just enough of RFC 3533 to track
+// packet boundaries and granule positions, not general multi-stream Ogg.
+func demuxOggOpus(src io.Reader, packets chan<- opusPacket) {
+	defer close(packets)
+
+	br := bufio.NewReaderSize(src, 64*1024)
+	var pending []byte
+	pagesSeen := 0
+
+	for {
+		header := make([]byte, 27)
+		if _, err := io.ReadFull(br, header); err != nil {
+			return
+		}
+		if string(header[0:4]) != "OggS" {
+			return
+		}
+
+		granule := int64(binary.LittleEndian.Uint64(header[6:14]))
+		segCount := int(header[26])
+
+		segTable := make([]byte, segCount)
+		if _, err := io.ReadFull(br, segTable); err != nil {
+			return
+		}
+
+		pagesSeen++
+		for _, segLen := range segTable {
+			buf := make([]byte, segLen)
+			if _, err := io.ReadFull(br, buf); err != nil {
+				return
+			}
+			pending = append(pending, buf...)
+
+			if segLen < 255 {
+				// Segment run ended: pending holds one complete packet.
+				if pagesSeen > 2 {
+					timestampMs := uint64(0)
+					if granule > 0 {
+						timestampMs = uint64(granule) * 1000 / 48000
+					}
+					packets <- opusPacket{data: pending, timestampMs: timestampMs}
+				}
+				pending = nil
+			}
+		}
+	}
+}